@@ -1,10 +1,14 @@
 package test
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"testing"
 	"time"
 
 	dbm "github.com/tendermint/tmlibs/db"
@@ -23,6 +27,13 @@ type WalletTestConfig struct {
 	Accounts   []*accountInfo `json:"accounts"`
 	Blocks     []*wtBlock     `json:"blocks"`
 	RollbackTo uint64         `json:"rollback_to"`
+	Switches   []*wtSwitch    `json:"switches"`
+}
+
+// wtSwitch reorganizes the wallet onto the tip of a named branch.
+type wtSwitch struct {
+	Branch     string            `json:"branch"`
+	PostStates []*accountBalance `json:"post_states"`
 }
 
 type keyInfo struct {
@@ -37,12 +48,31 @@ type accountInfo struct {
 }
 
 type wtBlock struct {
+	Branch          string            `json:"branch"`
+	Parent          string            `json:"parent"`
 	CoinbaseAccount string            `json:"coinbase_account"`
 	Transactions    []*wtTransaction  `json:"transactions"`
 	PostStates      []*accountBalance `json:"post_states"`
+	PostUTXOs       []*utxoAssertion  `json:"post_utxos"`
 	Append          uint64            `json:"append"`
 }
 
+// utxoAssertion declares the exact set of unspent outputs an account
+// should hold for an asset after a block.
+type utxoAssertion struct {
+	AccountAlias string       `json:"name"`
+	AssetAlias   string       `json:"asset"`
+	UTXOs        []*utxoState `json:"utxos"`
+}
+
+// utxoState describes one expected unspent output.
+type utxoState struct {
+	Amount              uint64 `json:"amount"`
+	ControlProgramIndex uint64 `json:"control_program_index"`
+	Change              bool   `json:"change"`
+	Matured             bool   `json:"matured"`
+}
+
 func (b *wtBlock) create(ctx *WalletTestContext) (*types.Block, error) {
 	transactions := []*types.Tx{}
 	for _, t := range b.Transactions {
@@ -56,7 +86,20 @@ func (b *wtBlock) create(ctx *WalletTestContext) (*types.Block, error) {
 }
 
 func (b *wtBlock) verifyPostStates(ctx *WalletTestContext) error {
-	for _, state := range b.PostStates {
+	return verifyBalances(ctx, b.PostStates)
+}
+
+func (b *wtBlock) verifyPostUTXOs(ctx *WalletTestContext) error {
+	for _, want := range b.PostUTXOs {
+		if err := ctx.verifyUTXOs(want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyBalances(ctx *WalletTestContext, states []*accountBalance) error {
+	for _, state := range states {
 		balance, err := ctx.getBalance(state.AccountAlias, state.AssetAlias)
 		if err != nil {
 			return err
@@ -70,9 +113,22 @@ func (b *wtBlock) verifyPostStates(ctx *WalletTestContext) error {
 }
 
 type wtTransaction struct {
-	Passwords []string  `json:"passwords"`
-	Inputs    []*action `json:"inputs"`
-	Outputs   []*action `json:"outputs"`
+	Passwords     []string        `json:"passwords"`
+	Inputs        []*action       `json:"inputs"`
+	Outputs       []*action       `json:"outputs"`
+	SigningRounds []*SigningRound `json:"signing_rounds"`
+}
+
+// SigningRound adds Passwords to the set of keys signed so far and calls
+// `generator.Sign` with the accumulated set, so a quorum > 1 account can
+// be signed across several rounds instead of all at once.
+type SigningRound struct {
+	Passwords []string `json:"passwords"`
+	// FullySigned, when true, asserts this round's Sign call completes
+	// the quorum; when false, it asserts Sign still returns an error.
+	FullySigned bool `json:"fully_signed"`
+	// ExpectErr, when set, is a substring the round's signing error must contain.
+	ExpectErr string `json:"expect_err"`
 }
 
 // create signed transaction
@@ -107,7 +163,44 @@ func (t *wtTransaction) create(ctx *WalletTestContext) (*types.Tx, error) {
 			}
 		}
 	}
-	return generator.Sign(t.Passwords)
+
+	if len(t.SigningRounds) == 0 {
+		return generator.Sign(t.Passwords)
+	}
+	return t.signRounds(generator)
+}
+
+// signRounds drives generator through each configured SigningRound,
+// accumulating passwords round over round, and returns the tx from the
+// round that completes the quorum.
+func (t *wtTransaction) signRounds(generator *TxGenerator) (*types.Tx, error) {
+	var tx *types.Tx
+	var passwords []string
+	for i, round := range t.SigningRounds {
+		passwords = append(passwords, round.Passwords...)
+		signed, err := generator.Sign(passwords)
+		if round.ExpectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), round.ExpectErr) {
+				return nil, fmt.Errorf("signing round %d: expected error containing %q, got %v", i, round.ExpectErr, err)
+			}
+			continue
+		}
+
+		if round.FullySigned {
+			if err != nil {
+				return nil, fmt.Errorf("signing round %d: %v", i, err)
+			}
+			tx = signed
+			continue
+		}
+		if err == nil {
+			return nil, fmt.Errorf("signing round %d: expected quorum not yet met, but Sign succeeded", i)
+		}
+	}
+	if tx == nil {
+		return nil, fmt.Errorf("signing rounds produced no fully-formed transaction")
+	}
+	return tx, nil
 }
 
 type action struct {
@@ -123,9 +216,22 @@ type accountBalance struct {
 	Amount       uint64 `json:"amount"`
 }
 
+// defaultBranch is the branch name used for blocks that don't declare one.
+const defaultBranch = "main"
+
 type WalletTestContext struct {
 	Wallet *w.Wallet
 	Chain  *protocol.Chain
+	// Clock supplies the timestamp for blocks minted by append.
+	Clock func() time.Time
+
+	activeBranch string
+	// branchChain holds, for each branch, the ancestry of blocks the
+	// fixture minted, from the height-1 block (index 0) to that branch's
+	// current tip; the genesis block is not included.
+	branchChain map[string][]*types.Block
+	// refChain indexes the same ancestries by "<branch>:<index>" for Parent lookups.
+	refChain map[string][]*types.Block
 }
 
 func (ctx *WalletTestContext) createControlProgram(accountName string, change bool) (*account.CtrlProgram, error) {
@@ -181,16 +287,6 @@ func (ctx *WalletTestContext) createAccount(name string, keys []string, quorum i
 	return err
 }
 
-func (ctx *WalletTestContext) update(block *types.Block) error {
-	if err := SolveAndUpdate(ctx.Chain, block); err != nil {
-		return err
-	}
-	if err := ctx.Wallet.AttachBlock(block); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (ctx *WalletTestContext) getBalance(accountAlias string, assetAlias string) (uint64, error) {
 	balances, err := ctx.Wallet.GetAccountBalances("")
 	if err != nil {
@@ -205,6 +301,56 @@ func (ctx *WalletTestContext) getBalance(accountAlias string, assetAlias string)
 	return 0, nil
 }
 
+func (ctx *WalletTestContext) getUTXOs(accountAlias, assetAlias string) ([]*account.UTXO, error) {
+	acc, err := ctx.Wallet.AccountMgr.FindByAlias(nil, accountAlias)
+	if err != nil {
+		return nil, err
+	}
+	asst, err := ctx.Wallet.AssetReg.FindByAlias(nil, assetAlias)
+	if err != nil {
+		return nil, err
+	}
+
+	utxos := []*account.UTXO{}
+	for _, u := range ctx.Wallet.AccountMgr.ListUnspentOutputs(false) {
+		if u.AccountID == acc.ID && u.AssetID == asst.AssetID {
+			utxos = append(utxos, u)
+		}
+	}
+	return utxos, nil
+}
+
+// isMatured reports whether u's coinbase maturity height has been reached.
+func (ctx *WalletTestContext) isMatured(u *account.UTXO) bool {
+	return u.ValidHeight == 0 || ctx.Chain.Height() >= u.ValidHeight
+}
+
+func (ctx *WalletTestContext) verifyUTXOs(want *utxoAssertion) error {
+	utxos, err := ctx.getUTXOs(want.AccountAlias, want.AssetAlias)
+	if err != nil {
+		return err
+	}
+	if len(utxos) != len(want.UTXOs) {
+		return fmt.Errorf("AccountAlias: %s, AssetAlias: %s, expected %d utxo(s), have %d", want.AccountAlias, want.AssetAlias, len(want.UTXOs), len(utxos))
+	}
+
+	remaining := append([]*account.UTXO{}, utxos...)
+	for _, wantUTXO := range want.UTXOs {
+		idx := -1
+		for i, u := range remaining {
+			if u.Amount == wantUTXO.Amount && u.ControlProgramIndex == wantUTXO.ControlProgramIndex && u.Change == wantUTXO.Change && ctx.isMatured(u) == wantUTXO.Matured {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			return fmt.Errorf("AccountAlias: %s, AssetAlias: %s, no matching utxo for %+v", want.AccountAlias, want.AssetAlias, *wantUTXO)
+		}
+		remaining = append(remaining[:idx], remaining[idx+1:]...)
+	}
+	return nil
+}
+
 func (ctx *WalletTestContext) getAccBalances() map[string]map[string]uint64 {
 	accBalances := make(map[string]map[string]uint64)
 	balances, err := ctx.Wallet.GetAccountBalances("")
@@ -226,17 +372,17 @@ func (ctx *WalletTestContext) getAccBalances() map[string]map[string]uint64 {
 	return accBalances
 }
 
-func (ctx *WalletTestContext) getDetachedBlocks(height uint64) ([]*types.Block, error) {
-	currentHeight := ctx.Chain.Height()
-	detachedBlocks := make([]*types.Block, 0, currentHeight-height)
-	for i := currentHeight; i > height; i-- {
-		block, err := ctx.Chain.GetBlockByHeight(i)
-		if err != nil {
-			return detachedBlocks, err
-		}
-		detachedBlocks = append(detachedBlocks, block)
+// getDetachedBlocks returns the blocks above height on branch's own
+// recorded ancestry, in descending height order. It reads branchChain
+// rather than the live ctx.Chain, whose tip may already sit on a
+// different branch by the time a rollback runs.
+func (ctx *WalletTestContext) getDetachedBlocks(branch string, height uint64) []*types.Block {
+	chain := ctx.branchChain[branch]
+	detachedBlocks := make([]*types.Block, 0, uint64(len(chain))-height)
+	for i := len(chain) - 1; i >= int(height); i-- {
+		detachedBlocks = append(detachedBlocks, chain[i])
 	}
-	return detachedBlocks, nil
+	return detachedBlocks
 }
 
 func (ctx *WalletTestContext) validateRollback(oldAccBalances map[string]map[string]uint64) error {
@@ -248,38 +394,212 @@ func (ctx *WalletTestContext) validateRollback(oldAccBalances map[string]map[str
 	}
 }
 
-func (ctx *WalletTestContext) append(blkNum uint64) error {
+// append mints blkNum empty blocks onto branch's current tip, attaching
+// them to the wallet only if branch is the active one.
+func (ctx *WalletTestContext) append(branch string, blkNum uint64) error {
+	if blkNum == 0 {
+		return nil
+	}
+
+	tip := ctx.branchChain[branch]
+	if err := ctx.setChainTip(tip); err != nil {
+		return err
+	}
+
 	for i := uint64(0); i < blkNum; i++ {
 		prevBlock := ctx.Chain.BestBlock()
-		timestamp := uint64(time.Now().Unix())
+		timestamp := uint64(ctx.Clock().Unix())
 		prevBlockHash := prevBlock.Hash()
 		block, err := DefaultEmptyBlock(prevBlock.Height+1, timestamp, prevBlockHash, prevBlock.Bits)
 		if err != nil {
 			return err
 		}
-		if err := ctx.update(block); err != nil {
-			return nil
+		if err := SolveAndUpdate(ctx.Chain, block); err != nil {
+			return err
+		}
+		ctx.recordBlock(branch, block)
+
+		if branch == ctx.activeBranch {
+			if err := ctx.Wallet.AttachBlock(block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// seedBranch initializes branch's ancestry from parent the first time
+// branch is seen, so a brand-new branch forked off another one (via
+// "parent": "<branch>:<index>") carries that branch's history forward
+// instead of starting from an empty chain.
+func (ctx *WalletTestContext) seedBranch(branch string, parent []*types.Block) {
+	if len(ctx.branchChain[branch]) > 0 || len(parent) == 0 {
+		return
+	}
+	ctx.branchChain[branch] = append([]*types.Block{}, parent...)
+}
+
+// recordBlock appends block to branch's ancestry, indexed as "<branch>:<index>".
+func (ctx *WalletTestContext) recordBlock(branch string, block *types.Block) {
+	chain := append(ctx.branchChain[branch], block)
+	ctx.branchChain[branch] = chain
+	ctx.refChain[fmt.Sprintf("%s:%d", branch, len(chain)-1)] = chain
+}
+
+// truncateBranch undoes the last n recordBlock calls on branch, keeping
+// branchChain/refChain consistent with a RollbackTo reorg.
+func (ctx *WalletTestContext) truncateBranch(branch string, n int) {
+	chain := ctx.branchChain[branch]
+	for i := len(chain) - n; i < len(chain); i++ {
+		delete(ctx.refChain, fmt.Sprintf("%s:%d", branch, i))
+	}
+	ctx.branchChain[branch] = chain[:len(chain)-n]
+}
+
+// parentChain resolves the ancestry a new block should extend.
+func (ctx *WalletTestContext) parentChain(branch, parentRef string) ([]*types.Block, error) {
+	if parentRef == "" {
+		return ctx.branchChain[branch], nil
+	}
+	chain, ok := ctx.refChain[parentRef]
+	if !ok {
+		return nil, fmt.Errorf("can't find parent block %s", parentRef)
+	}
+	return chain, nil
+}
+
+// setChainTip reorganizes the chain so its best block is chain's tip.
+func (ctx *WalletTestContext) setChainTip(chain []*types.Block) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	tip := chain[len(chain)-1]
+	if ctx.Chain.BestBlock().Hash() == tip.Hash() {
+		return nil
+	}
+	return ctx.Chain.ReorganizeChain(tip)
+}
+
+// switchBranch reorganizes the chain and wallet onto the tip of branch.
+func (ctx *WalletTestContext) switchBranch(branch string) error {
+	if branch == "" {
+		branch = defaultBranch
+	}
+	newChain, ok := ctx.branchChain[branch]
+	if !ok {
+		return fmt.Errorf("can't find branch %s", branch)
+	}
+	oldChain := ctx.branchChain[ctx.activeBranch]
+
+	common := 0
+	for common < len(oldChain) && common < len(newChain) && oldChain[common].Hash() == newChain[common].Hash() {
+		common++
+	}
+
+	if err := ctx.Chain.ReorganizeChain(newChain[len(newChain)-1]); err != nil {
+		return err
+	}
+	for i := len(oldChain) - 1; i >= common; i-- {
+		if err := ctx.Wallet.DetachBlock(oldChain[i]); err != nil {
+			return err
+		}
+	}
+	for i := common; i < len(newChain); i++ {
+		if err := ctx.Wallet.AttachBlock(newChain[i]); err != nil {
+			return err
 		}
 	}
+
+	ctx.activeBranch = branch
 	return nil
 }
 
-func (cfg *WalletTestConfig) Run() error {
-	dirPath, err := ioutil.TempDir(".", "pseudo_hsm")
+// RunConfig customizes how a WalletTestConfig fixture executes. A nil
+// RunConfig (or a nil T) runs in a fresh temp dir under the working
+// directory, removed when Run returns, and stamps blocks with time.Now.
+//
+// Seed only seeds RunAll's per-fixture Clock. pseudohsm.New and MockChain
+// take no rand source in this tree, so deterministic key/coinbase-address
+// generation is out of scope here; that would need changes to those
+// packages, which this series doesn't touch.
+type RunConfig struct {
+	T     *testing.T
+	Clock func() time.Time
+	Seed  int64
+}
+
+// tempDir returns t.TempDir() when available, or a manually-cleaned temp
+// dir otherwise.
+func tempDir(t *testing.T) (string, func(), error) {
+	if t != nil {
+		return t.TempDir(), func() {}, nil
+	}
+
+	dir, err := ioutil.TempDir(".", "wallet_test")
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, func() { os.RemoveAll(dir) }, nil
+}
+
+// RunAll loads every *.json fixture in dir and runs each as an isolated
+// parallel subtest of t.
+func RunAll(t *testing.T, dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		name := entry.Name()
+		seed := int64(i) + 1
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &WalletTestConfig{}
+			if err := json.Unmarshal(data, cfg); err != nil {
+				t.Fatalf("unmarshal %s: %v", name, err)
+			}
+
+			rc := &RunConfig{T: t, Seed: seed, Clock: func() time.Time { return time.Unix(seed, 0) }}
+			if err := cfg.Run(rc); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func (cfg *WalletTestConfig) Run(rc *RunConfig) error {
+	if rc == nil {
+		rc = &RunConfig{}
+	}
+	clock := rc.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+
+	baseDir, cleanup, err := tempDir(rc.T)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(dirPath)
-	hsm, err := pseudohsm.New(dirPath)
+	defer cleanup()
+
+	hsm, err := pseudohsm.New(filepath.Join(baseDir, "pseudo_hsm"))
 	if err != nil {
 		return err
 	}
 
-	db := dbm.NewDB("state_test_db", "leveldb", "state_test_db")
-	defer os.RemoveAll("state_test_db")
+	db := dbm.NewDB("state_test_db", "leveldb", baseDir)
 	chain, _ := MockChain(db)
-	walletDB := dbm.NewDB("wallet", "leveldb", "wallet_db")
-	defer os.RemoveAll("wallet_db")
+	walletDB := dbm.NewDB("wallet", "leveldb", baseDir)
 	accountManager := account.NewManager(walletDB, chain)
 	assets := asset.NewRegistry(walletDB, chain)
 	wallet, err := w.NewWallet(walletDB, accountManager, assets, hsm, chain)
@@ -287,8 +607,11 @@ func (cfg *WalletTestConfig) Run() error {
 		return err
 	}
 	ctx := &WalletTestContext{
-		Wallet: wallet,
-		Chain:  chain,
+		Wallet:      wallet,
+		Chain:       chain,
+		Clock:       clock,
+		branchChain: map[string][]*types.Block{},
+		refChain:    map[string][]*types.Block{},
 	}
 
 	for _, key := range cfg.Keys {
@@ -306,41 +629,82 @@ func (cfg *WalletTestConfig) Run() error {
 	var accBalances map[string]map[string]uint64
 	var rollbackBlock *types.Block
 	for _, blk := range cfg.Blocks {
+		branch := blk.Branch
+		if branch == "" {
+			branch = defaultBranch
+		}
+		if ctx.activeBranch == "" {
+			ctx.activeBranch = branch
+		}
+
+		parentChain, err := ctx.parentChain(branch, blk.Parent)
+		if err != nil {
+			return err
+		}
+		if err := ctx.setChainTip(parentChain); err != nil {
+			return err
+		}
+		ctx.seedBranch(branch, parentChain)
+
 		block, err := blk.create(ctx)
 		if err != nil {
 			return err
 		}
-		if err := ctx.update(block); err != nil {
+		if err := SolveAndUpdate(ctx.Chain, block); err != nil {
+			return err
+		}
+		ctx.recordBlock(branch, block)
+
+		if branch != ctx.activeBranch {
+			// side branch: not part of the wallet's view until switched to
+			if err := ctx.append(branch, blk.Append); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := ctx.Wallet.AttachBlock(block); err != nil {
 			return err
 		}
 		if err := blk.verifyPostStates(ctx); err != nil {
 			return err
 		}
+		if err := blk.verifyPostUTXOs(ctx); err != nil {
+			return err
+		}
 		if block.Height <= cfg.RollbackTo && cfg.RollbackTo <= block.Height+blk.Append {
 			accBalances = ctx.getAccBalances()
 			rollbackBlock = block
 		}
-		if err := ctx.append(blk.Append); err != nil {
+		if err := ctx.append(branch, blk.Append); err != nil {
 			return err
 		}
 	}
 
-	if rollbackBlock == nil {
-		return nil
+	if rollbackBlock != nil {
+		// rollback and validate
+		detachedBlocks := ctx.getDetachedBlocks(ctx.activeBranch, rollbackBlock.Height)
+		if err := ctx.Chain.ReorganizeChain(rollbackBlock); err != nil {
+			return err
+		}
+		for _, block := range detachedBlocks {
+			if err := ctx.Wallet.DetachBlock(block); err != nil {
+				return err
+			}
+		}
+		if err := ctx.validateRollback(accBalances); err != nil {
+			return err
+		}
+		ctx.truncateBranch(ctx.activeBranch, len(detachedBlocks))
 	}
 
-	// rollback and validate
-	detachedBlocks, err := ctx.getDetachedBlocks(rollbackBlock.Height)
-	if err != nil {
-		return err
-	}
-	if err := ctx.Chain.ReorganizeChain(rollbackBlock); err != nil {
-		return err
-	}
-	for _, block := range detachedBlocks {
-		if err := ctx.Wallet.DetachBlock(block); err != nil {
+	for _, sw := range cfg.Switches {
+		if err := ctx.switchBranch(sw.Branch); err != nil {
+			return err
+		}
+		if err := verifyBalances(ctx, sw.PostStates); err != nil {
 			return err
 		}
 	}
-	return ctx.validateRollback(accBalances)
+	return nil
 }
@@ -0,0 +1,7 @@
+package test
+
+import "testing"
+
+func TestWalletFixtures(t *testing.T) {
+	RunAll(t, "testdata")
+}